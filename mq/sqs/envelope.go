@@ -0,0 +1,115 @@
+package sqs
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// 内置EnvelopeDecoder的名字, 通过SQSConfig.Envelope选择
+const (
+	EnvelopeRaw         = "raw"         // 消息体原样透传, 不做任何解析, 没有meta
+	EnvelopeSNS         = "sns"         // SNS->SQS的{Message,Timestamp}通知信封
+	EnvelopeEventBridge = "eventbridge" // EventBridge事件信封
+	EnvelopeCloudEvents = "cloudevents" // CloudEvents 1.0 JSON格式信封
+)
+
+// EnvelopeDecoder 从SQS消息的原始Body中解出业务payload和信封附带的元数据.
+// 解析出的meta会透传给MessageCBWithMeta; Decode失败被视为不可重试的消息解析错误,
+// 交给RetryPolicy/DLQ处理而不是直接静默删除
+type EnvelopeDecoder interface {
+	Decode(rawBody string) (payload string, meta map[string]string, err error)
+}
+
+// rawEnvelopeDecoder 原样透传消息体, 不解析也没有元数据
+type rawEnvelopeDecoder struct{}
+
+func (rawEnvelopeDecoder) Decode(rawBody string) (string, map[string]string, error) {
+	return rawBody, nil, nil
+}
+
+// snsEnvelopeDecoder 解析SNS->SQS的{Message,Timestamp}通知信封
+type snsEnvelopeDecoder struct{}
+
+func (snsEnvelopeDecoder) Decode(rawBody string) (string, map[string]string, error) {
+	envelope := &struct {
+		Message   string `json:"Message"`
+		Timestamp string `json:"Timestamp"`
+	}{}
+	if err := json.Unmarshal([]byte(rawBody), envelope); err != nil {
+		return "", nil, errors.Wrap(err, "sqs snsEnvelopeDecoder decode")
+	}
+
+	var meta map[string]string
+	if envelope.Timestamp != "" {
+		meta = map[string]string{"Timestamp": envelope.Timestamp}
+	}
+	return envelope.Message, meta, nil
+}
+
+// eventBridgeEnvelopeDecoder 解析EventBridge事件信封, payload是detail字段原始JSON,
+// id/detail-type/source抽取到meta方便业务按事件类型路由
+type eventBridgeEnvelopeDecoder struct{}
+
+func (eventBridgeEnvelopeDecoder) Decode(rawBody string) (string, map[string]string, error) {
+	envelope := &struct {
+		Id         string          `json:"id"`
+		DetailType string          `json:"detail-type"`
+		Source     string          `json:"source"`
+		Detail     json.RawMessage `json:"detail"`
+	}{}
+	if err := json.Unmarshal([]byte(rawBody), envelope); err != nil {
+		return "", nil, errors.Wrap(err, "sqs eventBridgeEnvelopeDecoder decode")
+	}
+
+	meta := map[string]string{
+		"id":          envelope.Id,
+		"detail-type": envelope.DetailType,
+		"source":      envelope.Source,
+	}
+	return string(envelope.Detail), meta, nil
+}
+
+// cloudEventsEnvelopeDecoder 解析CloudEvents 1.0 JSON格式, payload是data字段,
+// id/type/source抽取到meta
+type cloudEventsEnvelopeDecoder struct{}
+
+func (cloudEventsEnvelopeDecoder) Decode(rawBody string) (string, map[string]string, error) {
+	envelope := &struct {
+		Id     string          `json:"id"`
+		Type   string          `json:"type"`
+		Source string          `json:"source"`
+		Data   json.RawMessage `json:"data"`
+	}{}
+	if err := json.Unmarshal([]byte(rawBody), envelope); err != nil {
+		return "", nil, errors.Wrap(err, "sqs cloudEventsEnvelopeDecoder decode")
+	}
+
+	meta := map[string]string{
+		"id":     envelope.Id,
+		"type":   envelope.Type,
+		"source": envelope.Source,
+	}
+	return string(envelope.Data), meta, nil
+}
+
+// resolveEnvelopeDecoder 按名字解析内置的EnvelopeDecoder, name为空时使用defaultName
+func resolveEnvelopeDecoder(name, defaultName string) (EnvelopeDecoder, error) {
+	if name == "" {
+		name = defaultName
+	}
+
+	switch strings.ToLower(name) {
+	case EnvelopeRaw:
+		return rawEnvelopeDecoder{}, nil
+	case EnvelopeSNS:
+		return snsEnvelopeDecoder{}, nil
+	case EnvelopeEventBridge:
+		return eventBridgeEnvelopeDecoder{}, nil
+	case EnvelopeCloudEvents:
+		return cloudEventsEnvelopeDecoder{}, nil
+	default:
+		return nil, errors.Errorf("sqs: unknown envelope decoder %q", name)
+	}
+}
@@ -0,0 +1,151 @@
+package sqs
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ChewZ-life/go-pkg/mq/utils/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// heartbeatVisibilityFactor 每次心跳延长的可见性时长相对HeartbeatInterval的倍数,
+// 留出余量避免两次心跳之间消息提前变为可见重新投递
+const heartbeatVisibilityFactor = 2
+
+// batchHeartbeat 在messageCB执行期间, 按HeartbeatInterval周期性地为当前ReceiveMessage批次中
+// 仍在处理的消息延长可见性超时, 避免长耗时的handler触发重复投递. 同一批次内所有消息的延长请求
+// 会被合并成一次ChangeMessageVisibilityBatch调用; 单条消息处理时长超过MaxHandleDuration后
+// 不再为它延长, 留给它自然过期后重新投递
+type batchHeartbeat struct {
+	s       *SQS
+	service *sqs.SQS
+	logTag  string
+
+	mu       sync.Mutex
+	inFlight map[string]*heartbeatEntry // receiptHandle -> entry
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type heartbeatEntry struct {
+	msg       *sqs.Message
+	startedAt time.Time
+}
+
+// newBatchHeartbeat 为一批消息启动心跳, HeartbeatInterval<=0时表示不开启心跳
+func newBatchHeartbeat(s *SQS, service *sqs.SQS, logTag string) *batchHeartbeat {
+	h := &batchHeartbeat{
+		s:        s,
+		service:  service,
+		logTag:   logTag,
+		inFlight: make(map[string]*heartbeatEntry),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if s.config.HeartbeatInterval <= 0 {
+		close(h.done)
+		return h
+	}
+
+	go h.run()
+	return h
+}
+
+// track 登记一条正在处理的消息, 必须在messageCB执行前调用
+func (h *batchHeartbeat) track(msg *sqs.Message) {
+	if h.s.config.HeartbeatInterval <= 0 || msg.ReceiptHandle == nil {
+		return
+	}
+	h.mu.Lock()
+	h.inFlight[*msg.ReceiptHandle] = &heartbeatEntry{msg: msg, startedAt: time.Now()}
+	h.mu.Unlock()
+}
+
+// untrack 取消登记, 必须在messageCB返回后立即调用(不管成功失败)
+func (h *batchHeartbeat) untrack(msg *sqs.Message) {
+	if h.s.config.HeartbeatInterval <= 0 || msg.ReceiptHandle == nil {
+		return
+	}
+	h.mu.Lock()
+	delete(h.inFlight, *msg.ReceiptHandle)
+	h.mu.Unlock()
+}
+
+// close 停止心跳goroutine并等待其退出, 应该在当前批次所有消息都处理完毕后调用
+func (h *batchHeartbeat) close() {
+	if h.s.config.HeartbeatInterval <= 0 {
+		return
+	}
+	select {
+	case <-h.stop:
+	default:
+		close(h.stop)
+	}
+	<-h.done
+}
+
+func (h *batchHeartbeat) run() {
+	defer close(h.done)
+
+	ticker := time.NewTicker(h.s.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			h.extend()
+		}
+	}
+}
+
+// extend 把当前仍在处理中的消息合并成一次ChangeMessageVisibilityBatch请求来延长可见性超时
+func (h *batchHeartbeat) extend() {
+	maxDuration := h.s.config.MaxHandleDuration
+	visibilityTimeout := aws.Int64(visibilityTimeoutSeconds(h.s.config.HeartbeatInterval * heartbeatVisibilityFactor))
+	now := time.Now()
+
+	h.mu.Lock()
+	var entries []*sqs.ChangeMessageVisibilityBatchRequestEntry
+	for receiptHandle, entry := range h.inFlight {
+		elapsed := now.Sub(entry.startedAt)
+		if maxDuration > 0 && elapsed >= maxDuration {
+			// 处理时长已超过上限, 不再延长, 留给它自然过期后重新投递
+			delete(h.inFlight, receiptHandle)
+			continue
+		}
+		timeout := visibilityTimeout
+		if maxDuration > 0 {
+			// 延长后的可见性超时不越过MaxHandleDuration
+			if remaining := visibilityTimeoutSeconds(maxDuration - elapsed); remaining < *timeout {
+				timeout = aws.Int64(remaining)
+			}
+		}
+		entries = append(entries, &sqs.ChangeMessageVisibilityBatchRequestEntry{
+			Id:                entry.msg.MessageId,
+			ReceiptHandle:     entry.msg.ReceiptHandle,
+			VisibilityTimeout: timeout,
+		})
+	}
+	h.mu.Unlock()
+
+	if len(entries) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := h.service.ChangeMessageVisibilityBatchWithContext(ctx, &sqs.ChangeMessageVisibilityBatchInput{
+		QueueUrl: aws.String(h.s.config.QueueUrl),
+		Entries:  entries,
+	})
+	if err != nil {
+		h.s.logger.ErrorWithFields(h.logTag+" heartbeat extend visibility fail.", log.Fields{"err": err.Error()})
+	}
+}
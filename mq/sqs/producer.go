@@ -0,0 +1,451 @@
+package sqs
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ChewZ-life/go-pkg/monitor"
+	"github.com/ChewZ-life/go-pkg/mq/utils/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+)
+
+const (
+	MonitorProducerFailure = "mq_sqs_producer_failure"
+	MonitorProducerTimeout = "mq_sqs_producer_timeout"
+)
+
+const (
+	ProducerTimeoutMS = int64(1000)
+
+	// batchMaxMessages SendMessageBatch单次请求最多消息数
+	batchMaxMessages = 10
+	// batchMaxBytes SendMessageBatch单次请求消息体总大小上限
+	batchMaxBytes = 256 * 1024
+	// batchWindow 凑批等待的最长时间, 由ProducerCnt个worker各自独立计时
+	batchWindow = 50 * time.Millisecond
+	// batchSendTimeout 单次SendMessageBatch请求的超时时间, Close触发后仍然用这个独立的超时
+	// 发送drain出来的消息, 不跟着已经取消的p.ctx一起失败
+	batchSendTimeout = 5 * time.Second
+)
+
+// errProducerClosed Close被调用之后, Send/SendBatch不再接受新消息时返回的错误
+var errProducerClosed = errors.New("sqs: producer closed")
+
+// SendOption 单条消息的可选参数
+type SendOption func(*sendOptions)
+
+type sendOptions struct {
+	attributes      map[string]string
+	delaySeconds    int64
+	deduplicationId *string
+	groupId         *string
+}
+
+// WithAttributes 设置消息属性
+func WithAttributes(attributes map[string]string) SendOption {
+	return func(o *sendOptions) { o.attributes = attributes }
+}
+
+// WithDelaySeconds 设置消息延迟可见的秒数
+func WithDelaySeconds(seconds int64) SendOption {
+	return func(o *sendOptions) { o.delaySeconds = seconds }
+}
+
+// WithDeduplicationId 设置FIFO队列的MessageDeduplicationId, 非FIFO队列会被忽略
+func WithDeduplicationId(id string) SendOption {
+	return func(o *sendOptions) { o.deduplicationId = aws.String(id) }
+}
+
+// WithGroupId 覆盖SQSConfig.MessageGroupId, 用于按消息粒度指定FIFO分组
+func WithGroupId(id string) SendOption {
+	return func(o *sendOptions) { o.groupId = aws.String(id) }
+}
+
+// Message SendBatch的单条消息
+type Message struct {
+	Body    string
+	Options []SendOption
+}
+
+// SendResult 单条消息的发送结果, 和Message按下标一一对应
+type SendResult struct {
+	MessageId string
+	Err       error
+}
+
+type pendingMessage struct {
+	entry  *sqs.SendMessageBatchRequestEntry
+	result chan SendResult
+}
+
+// Producer aws sqs生产者封装, Send内部按时间窗口将多次调用合并成一次SendMessageBatch请求
+type Producer struct {
+	config SQSConfig // 配置
+	logger *log.Log  // 日志
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+
+	pending chan *pendingMessage
+}
+
+// NewProducer 创建生产者, worker数量由SQSConfig.ProducerCnt决定
+func NewProducer(sqsConfig SQSConfig, logger *log.Log) *Producer {
+	return NewProducerWithContext(context.Background(), sqsConfig, logger)
+}
+
+// NewProducerWithContext 创建生产者, parentCtx取消后worker会在发送完已缓冲的消息后退出
+func NewProducerWithContext(parentCtx context.Context, sqsConfig SQSConfig, logger *log.Log) *Producer {
+	ctx, cancel := context.WithCancel(parentCtx)
+
+	cnt := sqsConfig.ProducerCnt
+	if cnt <= 0 {
+		cnt = 1
+	}
+
+	p := &Producer{
+		config:  sqsConfig,
+		logger:  logger,
+		ctx:     ctx,
+		cancel:  cancel,
+		pending: make(chan *pendingMessage, batchMaxMessages*cnt),
+	}
+
+	for i := 0; i < cnt; i++ {
+		p.wg.Add(1)
+		go p.run(i)
+	}
+
+	return p
+}
+
+// Close 停止接收新消息, 阻塞等待已缓冲的消息发送完毕, 直到worker退出或者ctx到期. 可以被重复调用.
+func (p *Producer) Close(ctx context.Context) error {
+	p.closeOnce.Do(p.cancel)
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Send 发送单条消息, 内部和同一时间窗口内的其它Send调用合并成一次SendMessageBatch请求
+func (p *Producer) Send(ctx context.Context, body string, opts ...SendOption) error {
+	entry, err := p.buildEntry(body, opts...)
+	if err != nil {
+		return err
+	}
+
+	// Close已经触发后不再接受新消息: worker的收尾drain只处理Close前就已经入队的消息,
+	// 这里新入队就再也没有人读取了
+	if p.ctx.Err() != nil {
+		return errProducerClosed
+	}
+
+	pm := &pendingMessage{entry: entry, result: make(chan SendResult, 1)}
+
+	select {
+	case p.pending <- pm:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.ctx.Done():
+		return errProducerClosed
+	}
+
+	select {
+	case res := <-pm.result:
+		return res.Err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.ctx.Done():
+		// pm已经在上面的select里被选中入队, 但worker可能已经在drain完成后退出, 不再有人往
+		// pm.result写结果, 这里不再无限等待调用方的ctx, 而是跟着producer的生命周期一起返回
+		return errProducerClosed
+	}
+}
+
+// SendBatch 将msgs按最多10条/256KB一批直接发送, 不经过Send的时间窗口缓冲
+func (p *Producer) SendBatch(ctx context.Context, msgs []Message) ([]SendResult, error) {
+	results := make([]SendResult, len(msgs))
+
+	var cfgSession *session.Session
+	var service *sqs.SQS
+	var err error
+
+	start := 0
+	for start < len(msgs) {
+		var chunk []*sqs.SendMessageBatchRequestEntry
+		chunkBytes := 0
+		end := start
+		for end < len(msgs) && len(chunk) < batchMaxMessages {
+			entry, buildErr := p.buildEntry(msgs[end].Body, msgs[end].Options...)
+			if buildErr != nil {
+				results[end] = SendResult{Err: buildErr}
+				end++
+				continue
+			}
+			bodyLen := len(*entry.MessageBody)
+			if len(chunk) > 0 && chunkBytes+bodyLen > batchMaxBytes {
+				break
+			}
+			entry.Id = aws.String(strconv.Itoa(end))
+			chunk = append(chunk, entry)
+			chunkBytes += bodyLen
+			end++
+		}
+
+		if len(chunk) > 0 {
+			if cfgSession, service, err = p.dial(cfgSession, service); err != nil {
+				for _, entry := range chunk {
+					idx, _ := strconv.Atoi(*entry.Id)
+					results[idx] = SendResult{Err: err}
+				}
+			} else {
+				chunkResults := p.sendChunk(ctx, service, chunk)
+				for id, res := range chunkResults {
+					idx, _ := strconv.Atoi(id)
+					results[idx] = res
+				}
+			}
+		}
+
+		start = end
+	}
+
+	return results, nil
+}
+
+func (p *Producer) run(i int) {
+	defer p.wg.Done()
+	p.logger.Infof("sqs Producer.run start. task_id:%d", i)
+
+	var cfgSession *session.Session
+	var service *sqs.SQS
+	var err error
+
+	var batch []*pendingMessage
+	batchBytes := 0
+	timer := time.NewTimer(batchWindow)
+	defer timer.Stop()
+
+	// flush 把batch按最多batchMaxMessages条/batchMaxBytes字节切成若干批分别发送, batch本身
+	// 可能已经超过单批上限(比如Close时一次性drain完p.pending里积压的消息), 不能假设它总是在
+	// 单次SendMessageBatch的限制以内
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		pending := batch
+		batch = nil
+		batchBytes = 0
+
+		start := 0
+		for start < len(pending) {
+			chunkBytes := 0
+			end := start
+			for end < len(pending) && end-start < batchMaxMessages {
+				bodyLen := len(*pending[end].entry.MessageBody)
+				if end > start && chunkBytes+bodyLen > batchMaxBytes {
+					break
+				}
+				chunkBytes += bodyLen
+				end++
+			}
+
+			chunk := pending[start:end]
+			entries := make([]*sqs.SendMessageBatchRequestEntry, len(chunk))
+			byId := make(map[string]*pendingMessage, len(chunk))
+			for idx, pm := range chunk {
+				id := strconv.Itoa(start + idx)
+				pm.entry.Id = aws.String(id)
+				entries[idx] = pm.entry
+				byId[id] = pm
+			}
+
+			cfgSession, service, err = p.dial(cfgSession, service)
+			if err != nil {
+				for _, pm := range chunk {
+					pm.result <- SendResult{Err: err}
+				}
+				start = end
+				continue
+			}
+
+			// Close后p.ctx已经被取消, 仍然要尽力把drain出来的消息发送完, 所以这里用独立的
+			// 超时context, 不跟着p.ctx一起失败
+			sendCtx, cancel := context.WithTimeout(context.Background(), batchSendTimeout)
+			results := p.sendChunk(sendCtx, service, entries)
+			cancel()
+			for id, pm := range byId {
+				pm.result <- results[id]
+			}
+
+			start = end
+		}
+	}
+
+	for {
+		select {
+		case pm := <-p.pending:
+			bodyLen := len(*pm.entry.MessageBody)
+			if len(batch) > 0 && (len(batch) >= batchMaxMessages || batchBytes+bodyLen > batchMaxBytes) {
+				flush()
+			}
+			batch = append(batch, pm)
+			batchBytes += bodyLen
+			if len(batch) >= batchMaxMessages || batchBytes >= batchMaxBytes {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+			timer.Reset(batchWindow)
+		case <-p.ctx.Done():
+			// 退出前把已经入队但还未发送的消息清空发送完
+			for {
+				select {
+				case pm := <-p.pending:
+					batch = append(batch, pm)
+					batchBytes += len(*pm.entry.MessageBody)
+				default:
+					flush()
+					p.logger.Infof("sqs Producer.run stop. task_id:%d", i)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (p *Producer) dial(cfgSession *session.Session, service *sqs.SQS) (*session.Session, *sqs.SQS, error) {
+	if service != nil {
+		return cfgSession, service, nil
+	}
+
+	if cfgSession == nil {
+		cfg := new(aws.Config)
+		if p.config.APIKey != "" && p.config.SecretKey != "" {
+			cfg = &aws.Config{
+				Region: aws.String(p.config.Region),
+				Credentials: credentials.NewStaticCredentials(
+					p.config.APIKey, p.config.SecretKey, ""),
+			}
+		} else {
+			cfg = &aws.Config{
+				Region: aws.String(p.config.Region),
+			}
+		}
+
+		var err error
+		cfgSession, err = session.NewSession(cfg)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "sqs Producer.dial session")
+		}
+	}
+
+	return cfgSession, sqs.New(cfgSession), nil
+}
+
+// sendChunk 发送最多一批(<=10条/256KB)消息, 返回以entry.Id为key的结果
+func (p *Producer) sendChunk(ctx context.Context, service *sqs.SQS, entries []*sqs.SendMessageBatchRequestEntry) map[string]SendResult {
+	results := make(map[string]SendResult, len(entries))
+
+	tp := time.Now()
+	out, err := service.SendMessageBatchWithContext(ctx, &sqs.SendMessageBatchInput{
+		Entries:  entries,
+		QueueUrl: aws.String(p.config.QueueUrl),
+	})
+	p.reportEvent(tp, err)
+	if err != nil {
+		p.logger.ErrorWithFields("sqs Producer.sendChunk send message batch fail.", log.Fields{"err": err.Error()})
+		for _, entry := range entries {
+			results[*entry.Id] = SendResult{Err: err}
+		}
+		return results
+	}
+
+	for _, ok := range out.Successful {
+		results[*ok.Id] = SendResult{MessageId: *ok.MessageId}
+	}
+	for _, fail := range out.Failed {
+		failErr := errors.Errorf("sqs Producer.sendChunk entry fail, code:%s message:%s", aws.StringValue(fail.Code), aws.StringValue(fail.Message))
+		results[*fail.Id] = SendResult{Err: failErr}
+	}
+
+	return results
+}
+
+func (p *Producer) buildEntry(body string, opts ...SendOption) (*sqs.SendMessageBatchRequestEntry, error) {
+	o := &sendOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	entry := &sqs.SendMessageBatchRequestEntry{
+		MessageBody: aws.String(body),
+	}
+
+	if o.delaySeconds > 0 {
+		entry.DelaySeconds = aws.Int64(o.delaySeconds)
+	}
+
+	if len(o.attributes) > 0 {
+		attrs := make(map[string]*sqs.MessageAttributeValue, len(o.attributes))
+		for k, v := range o.attributes {
+			attrs[k] = &sqs.MessageAttributeValue{
+				DataType:    aws.String("String"),
+				StringValue: aws.String(v),
+			}
+		}
+		entry.MessageAttributes = attrs
+	}
+
+	// FIFO队列相关参数, 消息级别的设置优先于配置
+	groupId := p.config.MessageGroupId
+	if o.groupId != nil {
+		groupId = o.groupId
+	}
+	if groupId != nil {
+		entry.MessageGroupId = groupId
+		if o.deduplicationId != nil {
+			entry.MessageDeduplicationId = o.deduplicationId
+		}
+	}
+
+	return entry, nil
+}
+
+func (p *Producer) reportEvent(tp time.Time, err error) {
+	if err != nil {
+		monitor.ReportEvent(MonitorProducerFailure, 1, map[string]interface{}{
+			"server": monitor.GetglobalLocalServerID(),
+			"ip":     monitor.GetglobalLocalIP(),
+			"arn":    p.config.ARN,
+			"err":    err.Error(),
+		})
+	}
+	cost := time.Since(tp).Milliseconds()
+	if cost > ProducerTimeoutMS {
+		monitor.ReportEvent(MonitorProducerTimeout, 1, map[string]interface{}{
+			"server": monitor.GetglobalLocalServerID(),
+			"ip":     monitor.GetglobalLocalIP(),
+			"arn":    p.config.ARN,
+			"cost":   cost,
+		})
+	}
+}
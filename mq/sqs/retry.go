@@ -0,0 +1,179 @@
+package sqs
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/ChewZ-life/go-pkg/mq/utils/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+)
+
+// messageCB可以通过wrap这些哨兵错误来告知processMessages该如何处理失败的消息:
+//
+//	ErrRetry: 可重试的临时错误, 按RetryPolicy计算退避时间后重新投递
+//	ErrDrop:  消息本身有问题(比如格式错误), 直接删除, 不再重试
+//	ErrPark:  重试无意义的业务错误, 转发到ParkingLotQueueUrl后删除
+//
+// 不满足errors.Is的普通error按ErrRetry处理
+var (
+	ErrRetry = errors.New("sqs: retry message")
+	ErrDrop  = errors.New("sqs: drop message")
+	ErrPark  = errors.New("sqs: park message")
+)
+
+// RetryPolicy 控制messageCB失败后的重试/退避/死信行为
+type RetryPolicy struct {
+	MaxAttempts        int           `mapstructure:"max_attempts" json:"max_attempts"`                   // 最大尝试次数, <=0表示不限制, 消息会一直重试
+	InitialBackoff     time.Duration `mapstructure:"initial_backoff" json:"initial_backoff"`             // 首次重试的退避时间
+	MaxBackoff         time.Duration `mapstructure:"max_backoff" json:"max_backoff"`                     // 退避时间上限
+	Jitter             float64       `mapstructure:"jitter" json:"jitter"`                               // 抖动比例, 取值[0,1], 实际退避时间在[backoff, backoff*(1+jitter)]之间
+	ParkingLotQueueUrl string        `mapstructure:"parking_lot_queue_url" json:"parking_lot_queue_url"` // 死信/parking-lot队列地址, 为空时ErrPark和重试耗尽的消息会被直接丢弃
+}
+
+// backoff 计算第attempt次投递(从1开始)失败后, 到下一次可见之前应该退避的时长.
+// attempt在MaxAttempts<=0("无限重试")时会随ApproximateReceiveCount无界增长, 所以翻倍是逐次
+// 进行而不是直接按attempt一次性移位: 每次翻倍前都检查是否已经到MaxBackoff或者int64溢出,
+// 一旦到了就停止翻倍, 避免d变成负数(或绕回0)之后被extendVisibility当成"不退避"处理掉
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	if p == nil || p.InitialBackoff <= 0 || attempt <= 0 {
+		return 0
+	}
+
+	d := p.InitialBackoff
+	for i := 1; i < attempt; i++ {
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			d = p.MaxBackoff
+			break
+		}
+		next := d * 2
+		if next <= d {
+			// 翻倍会溢出int64, 没有设置MaxBackoff就停在溢出前的最后一个有效值
+			break
+		}
+		d = next
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		d += time.Duration(float64(d) * p.Jitter * rand.Float64())
+	}
+	return d
+}
+
+// exhausted attempt(从1开始)是否已经达到允许的最大尝试次数
+func (p *RetryPolicy) exhausted(attempt int) bool {
+	return p != nil && p.MaxAttempts > 0 && attempt >= p.MaxAttempts
+}
+
+// visibilityTimeoutSeconds把d转成SQS ChangeMessageVisibility接受的整数秒, 向上取整到至少1秒:
+// d>0时直接截断成0会被SQS解读成"立即可见", 和延长可见性的本意正好相反
+func visibilityTimeoutSeconds(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	if secs := int64(d / time.Second); d%time.Second == 0 {
+		return secs
+	}
+	return int64(d/time.Second) + 1
+}
+
+// approxReceiveCount 读取SQS维护的ApproximateReceiveCount属性, 需要在ReceiveMessage时订阅该属性
+func approxReceiveCount(msg *sqs.Message) int {
+	if msg.Attributes == nil {
+		return 1
+	}
+	v, ok := msg.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]
+	if !ok || v == nil {
+		return 1
+	}
+	cnt, err := strconv.Atoi(*v)
+	if err != nil || cnt <= 0 {
+		return 1
+	}
+	return cnt
+}
+
+// retryActionTimeout parkMessage/extendVisibility这类收尾性质的API调用的超时时间, 故意不用
+// s.ctx: handleCallbackErr可能在Close已经触发、s.ctx已经被取消之后才跑完正在处理的最后一条消息,
+// 这时候还用s.ctx会导致请求直接失败, 该被转发到parking-lot的消息反而被当成已处理删除掉
+const retryActionTimeout = 5 * time.Second
+
+// handleCallbackErr 根据messageCB的返回结果决定消息的后续处理, 返回true表示消息应该从源队列删除,
+// 返回false表示消息被留在队列中等待退避后重新投递
+func (s *SQS) handleCallbackErr(service *sqs.SQS, logTag string, msg *sqs.Message, payload string, meta map[string]string, cbErr error) bool {
+	attempt := approxReceiveCount(msg)
+	policy := s.config.RetryPolicy
+
+	switch {
+	case errors.Is(cbErr, ErrDrop):
+		s.logger.ErrorWithFields(logTag+" drop message.", log.Fields{"err": cbErr.Error(), "msg": payload})
+		return true
+	case errors.Is(cbErr, ErrPark), policy.exhausted(attempt):
+		return s.parkMessage(service, logTag, msg, payload, meta, cbErr, attempt)
+	default:
+		s.extendVisibility(service, logTag, msg, policy.backoff(attempt))
+		return false
+	}
+}
+
+// parkMessage 把失败的消息连同失败元数据转发到parking-lot队列, 没有配置parking-lot队列时直接丢弃.
+// 转发的消息体是源消息未经解码的原始Body, 这样parking-lot队列被重新投递回源pipeline时还能按原来的信封解码;
+// meta是EnvelopeDecoder解出的信封元数据(比如SNS的Timestamp, EventBridge/CloudEvents的id/source等),
+// 以"Envelope."为key前缀当作MessageAttributes一并转发.
+// 返回true表示消息已经成功转发(或者没配置parking-lot队列, 按约定直接丢弃), 调用方可以把原消息
+// 从源队列删除; 返回false表示转发SendMessage失败, 原消息必须留在源队列里等待下一次重试,
+// 否则一次瞬时的网络/限流错误就会把这条消息彻底丢掉
+func (s *SQS) parkMessage(service *sqs.SQS, logTag string, msg *sqs.Message, payload string, meta map[string]string, cbErr error, attempt int) bool {
+	policy := s.config.RetryPolicy
+	if policy == nil || policy.ParkingLotQueueUrl == "" {
+		s.logger.ErrorWithFields(logTag+" park message without parking-lot queue, drop it.", log.Fields{"err": cbErr.Error(), "msg": payload, "attempt": attempt})
+		return true
+	}
+
+	attrs := map[string]*sqs.MessageAttributeValue{
+		"SourceQueueUrl": {DataType: aws.String("String"), StringValue: aws.String(s.config.QueueUrl)},
+		"FailureReason":  {DataType: aws.String("String"), StringValue: aws.String(cbErr.Error())},
+		"ReceiveCount":   {DataType: aws.String("Number"), StringValue: aws.String(strconv.Itoa(attempt))},
+	}
+	for k, v := range meta {
+		attrs["Envelope."+k] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(v)}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), retryActionTimeout)
+	defer cancel()
+
+	_, err := service.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:          aws.String(policy.ParkingLotQueueUrl),
+		MessageBody:       msg.Body,
+		MessageAttributes: attrs,
+	})
+	if err != nil {
+		s.logger.ErrorWithFields(logTag+" park message fail.", log.Fields{"err": err.Error(), "msg": payload})
+		return false
+	}
+	return true
+}
+
+// extendVisibility 将消息的可见性超时延后backoff再重新投递, backoff<=0时不做任何处理, 消息会在原visibility到期后立即重新投递
+func (s *SQS) extendVisibility(service *sqs.SQS, logTag string, msg *sqs.Message, backoff time.Duration) {
+	if backoff <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), retryActionTimeout)
+	defer cancel()
+
+	_, err := service.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(s.config.QueueUrl),
+		ReceiptHandle:     msg.ReceiptHandle,
+		VisibilityTimeout: aws.Int64(visibilityTimeoutSeconds(backoff)),
+	})
+	if err != nil {
+		s.logger.ErrorWithFields(logTag+" change message visibility fail.", log.Fields{"err": err.Error()})
+	}
+}
@@ -3,6 +3,7 @@ package sqs
 import (
 	"context"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ChewZ-life/go-pkg/mq/utils/log"
@@ -10,7 +11,6 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
-	jsoniter "github.com/json-iterator/go"
 	"github.com/pkg/errors"
 )
 
@@ -18,14 +18,25 @@ const (
 	HandleTimeoutMS = int64(1000)
 )
 
-// MessageCB
+// MessageCB 只拿到信封解码后的消息体
 type MessageCB func(msg string) error
 
+// MessageCBWithMeta 除消息体外还能拿到EnvelopeDecoder解析出的信封元数据(比如CloudEvents的type/source)
+type MessageCBWithMeta func(payload string, meta map[string]string) error
+
 // SQS aws sqs封装
 type SQS struct {
-	config    SQSConfig // 配置
-	logger    *log.Log  // 日志
-	messageCB MessageCB // 回调
+	config            SQSConfig         // 配置
+	logger            *log.Log          // 日志
+	messageCB         MessageCB         // 回调
+	messageCBWithMeta MessageCBWithMeta // 需要信封元数据时使用的回调, 和messageCB二选一
+	decoder           EnvelopeDecoder   // 消息信封解码器
+	waitSeconds       int64             // ReceiveMessage长轮询等待秒数
+
+	ctx       context.Context    // 控制worker生命周期的根context
+	cancel    context.CancelFunc // 触发worker停止拉取新消息
+	wg        sync.WaitGroup     // 等待所有worker退出
+	closeOnce sync.Once          // 保证Close可以被重复调用
 }
 
 // SQSConfig aws sqs相关配置
@@ -38,17 +49,27 @@ type SQSConfig struct {
 	MessageGroupId *string `mapstructure:"message_group_id" json:"message_group_id"`
 	ConsumerCnt    int     `mapstructure:"consumer_cnt" json:"consumer_cnt"` // 消费者数量
 	ProducerCnt    int     `mapstructure:"producer_cnt" json:"producer_cnt"` // 生产者
+
+	RetryPolicy *RetryPolicy `mapstructure:"retry_policy" json:"retry_policy"` // messageCB失败后的重试/死信策略, 为nil时保持之前的行为(一直重试直到visibility超时)
+
+	HeartbeatInterval time.Duration `mapstructure:"heartbeat_interval" json:"heartbeat_interval"`   // messageCB执行期间延长可见性超时的心跳间隔, <=0表示不开启心跳
+	MaxHandleDuration time.Duration `mapstructure:"max_handle_duration" json:"max_handle_duration"` // 心跳最多延长到的处理时长上限, 超过后不再延长, 消息按原visibility超时重新投递
+
+	Envelope string `mapstructure:"envelope" json:"envelope"` // 消息信封解码器名字(EnvelopeRaw/EnvelopeSNS/EnvelopeEventBridge/EnvelopeCloudEvents), 为空时使用构造函数各自的默认值
 }
 
 // 处理sns->sqs的消息
 func NewSQS(sqsConfig SQSConfig, logger *log.Log, messageCB MessageCB) *SQS {
-	s := &SQS{
-		config:    sqsConfig,
-		logger:    logger,
-		messageCB: messageCB,
-	}
+	return NewSQSWithContext(context.Background(), sqsConfig, logger, messageCB)
+}
+
+// NewSQSWithContext 处理sns->sqs的消息, parentCtx取消后worker会在完成当前消息的处理后退出,
+// 配合Close可以实现优雅停机
+func NewSQSWithContext(parentCtx context.Context, sqsConfig SQSConfig, logger *log.Log, messageCB MessageCB) *SQS {
+	s := newSQS(parentCtx, sqsConfig, logger, messageCB, nil, 20, EnvelopeSNS)
 
 	for i := 0; i < sqsConfig.ConsumerCnt; i++ {
+		s.wg.Add(1)
 		go s.processMessages(i)
 	}
 
@@ -57,27 +78,95 @@ func NewSQS(sqsConfig SQSConfig, logger *log.Log, messageCB MessageCB) *SQS {
 
 // 处理sqs->sqs的消息
 func NewSQSV1(sqsConfig SQSConfig, logger *log.Log, messageCB MessageCB) *SQS {
-	s := &SQS{
-		config:    sqsConfig,
-		logger:    logger,
-		messageCB: messageCB,
+	return NewSQSV1WithContext(context.Background(), sqsConfig, logger, messageCB)
+}
+
+// NewSQSV1WithContext 处理sqs->sqs的消息, parentCtx取消后worker会在完成当前消息的处理后退出,
+// 配合Close可以实现优雅停机
+func NewSQSV1WithContext(parentCtx context.Context, sqsConfig SQSConfig, logger *log.Log, messageCB MessageCB) *SQS {
+	s := newSQS(parentCtx, sqsConfig, logger, messageCB, nil, 5, EnvelopeRaw)
+
+	for i := 0; i < sqsConfig.ConsumerCnt; i++ {
+		s.wg.Add(1)
+		go s.processMessages(i)
 	}
 
+	return s
+}
+
+// NewSQSConsumer 创建消费者, 支持通过SQSConfig.Envelope选择内置的EnvelopeDecoder(为空时默认
+// EnvelopeRaw), messageCB除消息体外还能拿到解码器解析出的信封元数据
+func NewSQSConsumer(sqsConfig SQSConfig, logger *log.Log, messageCB MessageCBWithMeta) *SQS {
+	return NewSQSConsumerWithContext(context.Background(), sqsConfig, logger, messageCB)
+}
+
+// NewSQSConsumerWithContext 创建消费者, parentCtx取消后worker会在完成当前消息的处理后退出,
+// 配合Close可以实现优雅停机
+func NewSQSConsumerWithContext(parentCtx context.Context, sqsConfig SQSConfig, logger *log.Log, messageCB MessageCBWithMeta) *SQS {
+	s := newSQS(parentCtx, sqsConfig, logger, nil, messageCB, 20, EnvelopeRaw)
+
 	for i := 0; i < sqsConfig.ConsumerCnt; i++ {
-		go s.processMessagesV1(i)
+		s.wg.Add(1)
+		go s.processMessages(i)
 	}
 
 	return s
 }
 
+func newSQS(parentCtx context.Context, sqsConfig SQSConfig, logger *log.Log, messageCB MessageCB, messageCBWithMeta MessageCBWithMeta, waitSeconds int64, defaultEnvelope string) *SQS {
+	decoder, err := resolveEnvelopeDecoder(sqsConfig.Envelope, defaultEnvelope)
+	if err != nil {
+		logger.ErrorWithFields("sqs newSQS resolve envelope decoder fail, fallback to raw.", log.Fields{"envelope": sqsConfig.Envelope, "err": err.Error()})
+		decoder = rawEnvelopeDecoder{}
+	}
+
+	ctx, cancel := context.WithCancel(parentCtx)
+	return &SQS{
+		config:            sqsConfig,
+		logger:            logger,
+		messageCB:         messageCB,
+		messageCBWithMeta: messageCBWithMeta,
+		decoder:           decoder,
+		waitSeconds:       waitSeconds,
+		ctx:               ctx,
+		cancel:            cancel,
+	}
+}
+
+// Close 触发所有worker停止拉取新消息, 并阻塞等待当前正在执行的messageCB及收尾的DeleteMessageBatch完成,
+// 直到所有worker退出或者ctx到期. 可以被重复调用.
+func (s *SQS) Close(ctx context.Context) error {
+	s.closeOnce.Do(s.cancel)
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (s *SQS) processMessages(i int) {
+	defer s.wg.Done()
 	s.logger.Infof("sqs SQS.processMessages start. task_id:%d", i)
 
 	var cfgSession *session.Session
 	var service *sqs.SQS
 	var err error
-	var json = jsoniter.ConfigCompatibleWithStandardLibrary
 	for {
+		select {
+		case <-s.ctx.Done():
+			s.logger.Infof("sqs SQS.processMessages stop. task_id:%d", i)
+			return
+		default:
+		}
+
 		func() {
 			if cfgSession == nil {
 				cfg := new(aws.Config)
@@ -107,9 +196,9 @@ func (s *SQS) processMessages(i int) {
 			}
 
 			// 拉取消息
-			const waitSeconds = 20
 			const messageCount = 10
-			ctx, cancel := context.WithTimeout(context.Background(), (waitSeconds+1)*time.Second)
+			waitSeconds := s.waitSeconds
+			ctx, cancel := context.WithTimeout(s.ctx, time.Duration(waitSeconds+1)*time.Second)
 			defer cancel()
 
 			msgResult, err := service.ReceiveMessageWithContext(ctx,
@@ -117,9 +206,14 @@ func (s *SQS) processMessages(i int) {
 					QueueUrl:            aws.String(s.config.QueueUrl),
 					MaxNumberOfMessages: aws.Int64(messageCount),
 					WaitTimeSeconds:     aws.Int64(waitSeconds),
+					AttributeNames:      []*string{aws.String(sqs.MessageSystemAttributeNameApproximateReceiveCount)},
 				})
 			if err != nil {
-				s.logger.ErrorWithFields("sqs SQS.processMessages receive message fail.", log.Fields{"err": err.Error()})
+				// s.ctx.Err() != nil说明是Close触发的取消, 拉取被正常中断而不是失败,
+				// 不应该产生ERROR日志, 否则每次优雅退出都会被误判为故障
+				if s.ctx.Err() == nil && !strings.Contains(err.Error(), "context deadline exceeded") {
+					s.logger.ErrorWithFields("sqs SQS.processMessages receive message fail.", log.Fields{"err": err.Error()})
+				}
 				return
 			}
 
@@ -128,146 +222,54 @@ func (s *SQS) processMessages(i int) {
 			}
 
 			// 处理消息
+			heartbeat := newBatchHeartbeat(s, service, "sqs SQS.processMessages")
+			defer heartbeat.close()
+
 			var deleteEntries []*sqs.DeleteMessageBatchRequestEntry
 			for _, msg := range msgResult.Messages {
 				if msg.Body == nil {
 					continue
 				}
 
-				rawMessage := &struct {
-					Message   string `json:"Message"`
-					Timestamp string `json:"Timestamp"`
-				}{}
-				if err = json.Unmarshal([]byte(*msg.Body), rawMessage); err != nil {
-					// 消息反序列化失败, 认为是错误的消息, 删除就好了
-					deleteEntries = append(deleteEntries, &sqs.DeleteMessageBatchRequestEntry{
-						Id:            msg.MessageId,
-						ReceiptHandle: msg.ReceiptHandle,
-					})
-					s.logger.ErrorWithFields("sqs SQS.processMessages unmarshal raw message fail.", log.Fields{"err": err.Error(), "msg": *msg.Body})
-					continue
-				}
-
-				// 结果的回调
-				if s.messageCB != nil {
-					tp := time.Now()
-					err = s.messageCB(rawMessage.Message)
-					if err != nil {
-						s.logger.ErrorWithFields("sqs SQS.processMessages handle msg fail.", log.Fields{"err": err.Error(), "msg": rawMessage.Message})
+				payload, meta, decodeErr := s.decoder.Decode(*msg.Body)
+				if decodeErr != nil {
+					s.logger.ErrorWithFields("sqs SQS.processMessages decode envelope fail.", log.Fields{"err": decodeErr.Error(), "msg": *msg.Body})
+					// 信封解析失败是确定性的格式错误, 重试不会让结果变好, 按ErrPark处理直接转发/丢弃,
+					// 而不是走默认的重试退避(没配置RetryPolicy时会导致同一条坏消息无限重试)
+					if !s.handleCallbackErr(service, "sqs SQS.processMessages", msg, *msg.Body, nil, errors.Wrap(ErrPark, decodeErr.Error())) {
 						continue
 					}
-					cost := time.Since(tp).Milliseconds()
-					if cost > HandleTimeoutMS {
-						s.logger.ErrorWithFields("sqs SQS.processMessages handle msg cost.", log.Fields{"sqsArn": s.config.ARN, "cost": cost})
-					}
-					// 回调成功后删除消息
 					deleteEntries = append(deleteEntries, &sqs.DeleteMessageBatchRequestEntry{
 						Id:            msg.MessageId,
 						ReceiptHandle: msg.ReceiptHandle,
 					})
-				}
-			}
-
-			if len(deleteEntries) == 0 {
-				return
-			}
-
-			// 删除消息
-			ctx2, cancel2 := context.WithTimeout(context.Background(), time.Second)
-			defer cancel2()
-
-			_, err = service.DeleteMessageBatchWithContext(ctx2,
-				&sqs.DeleteMessageBatchInput{
-					Entries:  deleteEntries,
-					QueueUrl: &s.config.QueueUrl,
-				})
-			if err != nil {
-				s.logger.ErrorWithFields("sqs SQS.processMessages delete message fail.", log.Fields{"error": err.Error()})
-				return
-			}
-		}()
-	}
-}
-
-func (s *SQS) processMessagesV1(i int) {
-	s.logger.Infof("sqs SQS.processMessagesV1 start. task_id:%d", i)
-
-	var cfgSession *session.Session
-	var service *sqs.SQS
-	var err error
-	for {
-		func() {
-			if cfgSession == nil {
-				cfg := new(aws.Config)
-				if s.config.APIKey != "" && s.config.SecretKey != "" {
-					cfg = &aws.Config{
-						Region: aws.String(s.config.Region),
-						Credentials: credentials.NewStaticCredentials(
-							s.config.APIKey, s.config.SecretKey, ""),
-					}
-				} else {
-					cfg = &aws.Config{
-						Region: aws.String(s.config.Region),
-					}
-				}
-				cfgSession, err = session.NewSession(cfg)
-				if err != nil {
-					err = errors.Wrap(err, "sqs SQS.processMessagesV1 session")
-					s.logger.ErrorWithFields("sqs SQS.processMessagesV1 session", log.Fields{"err": err.Error()})
-					return
-				}
-				s.logger.Info("sqs SQS.processMessagesV1 session init success")
-			}
-
-			if service == nil {
-				service = sqs.New(cfgSession)
-			}
-
-			// 拉取消息
-			const waitSeconds = 5
-			const messageCount = 10
-			ctx, cancel := context.WithTimeout(context.Background(), (waitSeconds+1)*time.Second)
-			defer cancel()
-
-			msgResult, err := service.ReceiveMessageWithContext(ctx,
-				&sqs.ReceiveMessageInput{
-					QueueUrl:            aws.String(s.config.QueueUrl),
-					MaxNumberOfMessages: aws.Int64(messageCount),
-					WaitTimeSeconds:     aws.Int64(waitSeconds),
-				})
-			if err != nil {
-				if !strings.Contains(err.Error(), "context deadline exceeded") {
-					s.logger.ErrorWithFields("sqs SQS.processMessagesV1 receive message fail.", log.Fields{"err": err.Error()})
-				}
-				return
-			}
-
-			if len(msgResult.Messages) == 0 {
-				return
-			}
-
-			s.logger.InfoWithFields("sqs SQS.processMessagesV1 received messages", log.Fields{"len": len(msgResult.Messages)})
-
-			// 处理消息
-			var deleteEntries []*sqs.DeleteMessageBatchRequestEntry
-			for i, msg := range msgResult.Messages {
-				if msg.Body == nil {
 					continue
 				}
 
-				s.logger.InfoWithFields("sqs SQS.processMessagesV1 handle message", log.Fields{"index": i, "msg": *msg})
-
 				// 结果的回调
-				if s.messageCB != nil {
+				if s.messageCB != nil || s.messageCBWithMeta != nil {
 					tp := time.Now()
-					err = s.messageCB(*msg.Body)
+					heartbeat.track(msg)
+					if s.messageCBWithMeta != nil {
+						err = s.messageCBWithMeta(payload, meta)
+					} else {
+						err = s.messageCB(payload)
+					}
+					heartbeat.untrack(msg)
 					if err != nil {
-						s.logger.ErrorWithFields("sqs SQS.processMessagesV1 handle msg fail.", log.Fields{"err": err.Error(), "msg": *msg.Body})
+						s.logger.ErrorWithFields("sqs SQS.processMessages handle msg fail.", log.Fields{"err": err.Error(), "msg": payload})
+						if !s.handleCallbackErr(service, "sqs SQS.processMessages", msg, payload, meta, err) {
+							continue
+						}
+						deleteEntries = append(deleteEntries, &sqs.DeleteMessageBatchRequestEntry{
+							Id:            msg.MessageId,
+							ReceiptHandle: msg.ReceiptHandle,
+						})
 						continue
 					}
 					cost := time.Since(tp).Milliseconds()
 					if cost > HandleTimeoutMS {
-						s.logger.ErrorWithFields("sqs SQS.processMessagesV1 handle msg cost.", log.Fields{"sqsArn": s.config.ARN, "cost": cost})
+						s.logger.ErrorWithFields("sqs SQS.processMessages handle msg cost.", log.Fields{"sqsArn": s.config.ARN, "cost": cost})
 					}
 					// 回调成功后删除消息
 					deleteEntries = append(deleteEntries, &sqs.DeleteMessageBatchRequestEntry{
@@ -291,7 +293,7 @@ func (s *SQS) processMessagesV1(i int) {
 					QueueUrl: &s.config.QueueUrl,
 				})
 			if err != nil {
-				s.logger.ErrorWithFields("sqs SQS.processMessagesV1 delete message fail.", log.Fields{"error": err.Error()})
+				s.logger.ErrorWithFields("sqs SQS.processMessages delete message fail.", log.Fields{"error": err.Error()})
 				return
 			}
 		}()